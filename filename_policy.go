@@ -0,0 +1,94 @@
+package binding
+
+import (
+	"mime"
+	"mime/multipart"
+	"strings"
+)
+
+// FilenamePolicy controls how MultipartFormStream handles the filename a
+// client supplies for a file part.
+type FilenamePolicy string
+
+const (
+	// FilenamePolicySanitize decodes an RFC 5987 filename* parameter when
+	// present, strips any directory components (both "/" and "\", since a
+	// client may be on a different OS than the server), and neutralizes ".."
+	// traversal segments, NUL bytes and a leading Windows drive letter. It
+	// is the default when FilenamePolicy is left at its zero value.
+	FilenamePolicySanitize FilenamePolicy = "sanitize"
+
+	// FilenamePolicyRaw passes the filename through exactly as
+	// (*multipart.Part).FileName() parsed it.
+	FilenamePolicyRaw FilenamePolicy = "raw"
+
+	// FilenamePolicyReject aborts the part with SuspiciousFilenameError if
+	// its filename isn't already clean, rather than silently sanitizing it.
+	FilenamePolicyReject FilenamePolicy = "reject"
+)
+
+// SuspiciousFilenameError is the error code recorded in Errors when
+// FilenamePolicyReject rejects a file part's filename.
+const SuspiciousFilenameError string = "SuspiciousFilenameError"
+
+// applyFilenamePolicy resolves part's filename under policy, returning the
+// filename readFilePart should bind it under and whether the part should be
+// rejected outright (only possible under FilenamePolicyReject).
+func applyFilenamePolicy(part *multipart.Part, policy FilenamePolicy) (filename string, suspicious bool) {
+	switch policy {
+	case FilenamePolicyRaw:
+		return part.FileName(), false
+	case FilenamePolicyReject:
+		raw := resolveFilename(part)
+		return raw, sanitizeFilename(raw) != raw
+	default:
+		return sanitizeFilename(resolveFilename(part)), false
+	}
+}
+
+// resolveFilename returns the filename part carries, re-parsing its
+// Content-Disposition header so an RFC 5987 extended parameter
+// (filename*=UTF-8”...) is preferred the same way any other RFC 2231
+// extended parameter would be, rather than trusting that FileName() already
+// picked it up.
+func resolveFilename(part *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil {
+		return part.FileName()
+	}
+	if filename, ok := params["filename"]; ok {
+		return filename
+	}
+	return part.FileName()
+}
+
+// sanitizeFilename strips directory components (both "/" and "\"), a
+// leading Windows drive letter (e.g. "C:"), NUL bytes, and any remaining
+// ".." traversal segment, leaving a bare file name that's safe to bind or,
+// by a caller, to use as part of a storage path.
+func sanitizeFilename(name string) string {
+	name = strings.ReplaceAll(name, "\x00", "")
+
+	if len(name) >= 2 && name[1] == ':' && isASCIILetter(name[0]) {
+		name = name[2:]
+	}
+
+	name = strings.ReplaceAll(name, "\\", "/")
+	if i := strings.LastIndexByte(name, '/'); i != -1 {
+		name = name[i+1:]
+	}
+
+	if name == "." || name == ".." {
+		name = ""
+	}
+
+	if name == "" {
+		name = "unnamed"
+	}
+
+	return name
+}
+
+func isASCIILetter(b byte) bool {
+	return (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
@@ -0,0 +1,176 @@
+package binding
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+
+	"github.com/go-martini/martini"
+)
+
+// buildRequestWithFilePart posts a single file part under fieldName whose
+// Content-Disposition is exactly disposition, letting tests exercise
+// filenames multipart.Writer.CreateFormFile can't express (filename*,
+// backslashes, traversal sequences).
+func buildRequestWithFilePart(fieldName, disposition, data string) *http.Request {
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", disposition)
+	header.Set("Content-Type", "text/plain")
+
+	part, err := w.CreatePart(header)
+	if err != nil {
+		panic(err)
+	}
+	part.Write([]byte(data))
+
+	if err := w.Close(); err != nil {
+		panic(err)
+	}
+
+	req, err := http.NewRequest("POST", testRoute, body)
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	return req
+}
+
+func TestMultipartFormStreamSanitizesPathTraversalFilename(t *testing.T) {
+	httpRecorder := httptest.NewRecorder()
+	m := martini.Classic()
+
+	opts := MultipartOptions{MaxMemory: 1 << 20}
+
+	var gotPost BlogPost
+	m.Post(testRoute, MultipartFormStream(BlogPost{}, opts), func(actual BlogPost, errs Errors) {
+		gotPost = actual
+	})
+
+	disposition := `form-data; name="headerImage"; filename="../../etc/passwd"`
+	m.ServeHTTP(httpRecorder, buildRequestWithFilePart("headerImage", disposition, "data"))
+
+	if gotPost.HeaderImage == nil {
+		t.Fatal("expected the file to be bound")
+	}
+	if gotPost.HeaderImage.Filename != "passwd" {
+		t.Errorf("expected the traversal sequence to be stripped, got %q", gotPost.HeaderImage.Filename)
+	}
+}
+
+func TestMultipartFormStreamSanitizesWindowsStylePath(t *testing.T) {
+	httpRecorder := httptest.NewRecorder()
+	m := martini.Classic()
+
+	opts := MultipartOptions{MaxMemory: 1 << 20}
+
+	var gotPost BlogPost
+	m.Post(testRoute, MultipartFormStream(BlogPost{}, opts), func(actual BlogPost, errs Errors) {
+		gotPost = actual
+	})
+
+	disposition := `form-data; name="headerImage"; filename="C:\Users\bob\report.csv"`
+	m.ServeHTTP(httpRecorder, buildRequestWithFilePart("headerImage", disposition, "data"))
+
+	if gotPost.HeaderImage == nil {
+		t.Fatal("expected the file to be bound")
+	}
+	if gotPost.HeaderImage.Filename != "report.csv" {
+		t.Errorf("expected the drive letter and directories to be stripped, got %q", gotPost.HeaderImage.Filename)
+	}
+}
+
+func TestMultipartFormStreamDecodesRFC5987Filename(t *testing.T) {
+	httpRecorder := httptest.NewRecorder()
+	m := martini.Classic()
+
+	opts := MultipartOptions{MaxMemory: 1 << 20}
+
+	var gotPost BlogPost
+	m.Post(testRoute, MultipartFormStream(BlogPost{}, opts), func(actual BlogPost, errs Errors) {
+		gotPost = actual
+	})
+
+	disposition := `form-data; name="headerImage"; filename="bericht.txt"; filename*=UTF-8''bericht%C3%9F.txt`
+	m.ServeHTTP(httpRecorder, buildRequestWithFilePart("headerImage", disposition, "data"))
+
+	if gotPost.HeaderImage == nil {
+		t.Fatal("expected the file to be bound")
+	}
+	if gotPost.HeaderImage.Filename != "berichtß.txt" {
+		t.Errorf("expected the RFC 5987 filename* to win, got %q", gotPost.HeaderImage.Filename)
+	}
+}
+
+func TestMultipartFormStreamRejectPolicyFlagsSuspiciousFilename(t *testing.T) {
+	httpRecorder := httptest.NewRecorder()
+	m := martini.Classic()
+
+	opts := MultipartOptions{MaxMemory: 1 << 20, FilenamePolicy: FilenamePolicyReject}
+
+	var gotErrors Errors
+	var gotPost BlogPost
+	m.Post(testRoute, MultipartFormStream(BlogPost{}, opts), func(actual BlogPost, errs Errors) {
+		gotPost = actual
+		gotErrors = errs
+	})
+
+	disposition := `form-data; name="headerImage"; filename="../secrets.txt"`
+	m.ServeHTTP(httpRecorder, buildRequestWithFilePart("headerImage", disposition, "data"))
+
+	if gotPost.HeaderImage != nil {
+		t.Errorf("expected the suspicious filename to be rejected, but it was bound")
+	}
+	assertHasError(t, gotErrors, "headerImage", SuspiciousFilenameError)
+}
+
+func TestMultipartFormStreamRejectPolicyAllowsCleanFilename(t *testing.T) {
+	httpRecorder := httptest.NewRecorder()
+	m := martini.Classic()
+
+	opts := MultipartOptions{MaxMemory: 1 << 20, FilenamePolicy: FilenamePolicyReject}
+
+	var gotErrors Errors
+	var gotPost BlogPost
+	m.Post(testRoute, MultipartFormStream(BlogPost{}, opts), func(actual BlogPost, errs Errors) {
+		gotPost = actual
+		gotErrors = errs
+	})
+
+	disposition := `form-data; name="headerImage"; filename="report.csv"`
+	m.ServeHTTP(httpRecorder, buildRequestWithFilePart("headerImage", disposition, "data"))
+
+	if gotErrors.Len() != 0 {
+		t.Errorf("expected no errors for an already-clean filename, got %v", gotErrors)
+	}
+	if gotPost.HeaderImage == nil || gotPost.HeaderImage.Filename != "report.csv" {
+		t.Errorf("expected the clean filename to bind unchanged, got %v", gotPost.HeaderImage)
+	}
+}
+
+func TestMultipartFormStreamRawPolicyPassesFilenameThrough(t *testing.T) {
+	httpRecorder := httptest.NewRecorder()
+	m := martini.Classic()
+
+	opts := MultipartOptions{MaxMemory: 1 << 20, FilenamePolicy: FilenamePolicyRaw}
+
+	var gotPost BlogPost
+	m.Post(testRoute, MultipartFormStream(BlogPost{}, opts), func(actual BlogPost, errs Errors) {
+		gotPost = actual
+	})
+
+	disposition := `form-data; name="headerImage"; filename="C:\Users\bob\report.csv"`
+	m.ServeHTTP(httpRecorder, buildRequestWithFilePart("headerImage", disposition, "data"))
+
+	if gotPost.HeaderImage == nil {
+		t.Fatal("expected the file to be bound")
+	}
+	if gotPost.HeaderImage.Filename != `C:\Users\bob\report.csv` {
+		t.Errorf("expected FilenamePolicyRaw to leave the filename untouched, got %q", gotPost.HeaderImage.Filename)
+	}
+}
@@ -0,0 +1,147 @@
+package binding
+
+import (
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/go-martini/martini"
+)
+
+// GraphQLMultipart implements the GraphQL multipart request spec
+// (https://github.com/jaydenseric/graphql-multipart-request-spec), so a
+// Martini handler can accept file uploads posted by Apollo/graphql-request
+// clients alongside a GraphQL operation.
+//
+// The request must be a standard multipart form carrying:
+//   - an "operations" field holding the GraphQL operation(s) as JSON, which
+//     is unmarshalled into obj
+//   - a "map" field holding a JSON object of the form
+//     {"<multipart field name>": ["<dotted path into operations>", ...]}
+//   - one multipart file field per key named in map
+//
+// Each dotted path (e.g. "variables.file" or "variables.files.0") is
+// resolved against obj's JSON tags and must address a *multipart.FileHeader
+// or []*multipart.FileHeader field.
+func GraphQLMultipart(obj interface{}, ifacePtr ...interface{}) martini.Handler {
+	ensureNotPointer(obj)
+	return func(context martini.Context, req *http.Request) {
+		objVal := reflect.New(reflect.TypeOf(obj))
+		errs := newErrors()
+
+		if err := req.ParseMultipartForm(MaxMemory); err != nil {
+			errs.Add([]string{}, DeserializationError, err.Error())
+			validateAndMap(objVal, context, errs, ifacePtr...)
+			return
+		}
+
+		operations := req.FormValue("operations")
+		if operations == "" {
+			errs.Add([]string{"operations"}, RequiredError, "operations field is required")
+		} else if err := json.Unmarshal([]byte(operations), objVal.Interface()); err != nil {
+			errs.Add([]string{"operations"}, DeserializationError, err.Error())
+		}
+
+		mapField := req.FormValue("map")
+		var paths map[string][]string
+		if mapField == "" {
+			errs.Add([]string{"map"}, RequiredError, "map field is required")
+		} else if err := json.Unmarshal([]byte(mapField), &paths); err != nil {
+			errs.Add([]string{"map"}, DeserializationError, "malformed map field: "+err.Error())
+		}
+
+		for fieldName, targets := range paths {
+			fileHeaders := req.MultipartForm.File[fieldName]
+			if len(fileHeaders) == 0 {
+				errs.Add([]string{fieldName}, RequiredError, "no file uploaded for map key \""+fieldName+"\"")
+				continue
+			}
+			for i, path := range targets {
+				fh := fileHeaders[0]
+				if i < len(fileHeaders) {
+					fh = fileHeaders[i]
+				}
+				if err := setFileHeaderAtPath(objVal.Elem(), path, fh); err != nil {
+					errs.Add([]string{fieldName}, DeserializationError, "map path \""+path+"\": "+err.Error())
+				}
+			}
+		}
+
+		validateAndMap(objVal, context, errs, ifacePtr...)
+	}
+}
+
+// setFileHeaderAtPath walks path (dot-separated JSON field names and slice
+// indices) from root and assigns fh to the *multipart.FileHeader or
+// []*multipart.FileHeader field it resolves to.
+func setFileHeaderAtPath(root reflect.Value, path string, fh *multipart.FileHeader) error {
+	segments := strings.Split(path, ".")
+	cur := root
+
+	for i, seg := range segments {
+		for cur.Kind() == reflect.Ptr {
+			if cur.IsNil() {
+				cur.Set(reflect.New(cur.Type().Elem()))
+			}
+			cur = cur.Elem()
+		}
+
+		if idx, err := strconv.Atoi(seg); err == nil {
+			if cur.Kind() != reflect.Slice {
+				return errors.New("path segment \"" + seg + "\" expects a slice field")
+			}
+			for cur.Len() <= idx {
+				cur.Set(reflect.Append(cur, reflect.Zero(cur.Type().Elem())))
+			}
+			cur = cur.Index(idx)
+		} else {
+			if cur.Kind() != reflect.Struct {
+				return errors.New("path segment \"" + seg + "\" expects a struct field")
+			}
+			field, ok := jsonTaggedField(cur, seg)
+			if !ok {
+				return errors.New("no field tagged json:\"" + seg + "\"")
+			}
+			cur = field
+		}
+
+		if i == len(segments)-1 {
+			return assignFileHeader(cur, fh)
+		}
+	}
+
+	return errors.New("empty map path")
+}
+
+// jsonTaggedField finds the field of structVal whose `json` tag name (or, if
+// untagged, Go field name) matches name.
+func jsonTaggedField(structVal reflect.Value, name string) (reflect.Value, bool) {
+	t := structVal.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tagName := strings.Split(f.Tag.Get("json"), ",")[0]
+		if tagName == name || (tagName == "" && f.Name == name) {
+			return structVal.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+var fileHeaderType = reflect.TypeOf((*multipart.FileHeader)(nil))
+
+func assignFileHeader(field reflect.Value, fh *multipart.FileHeader) error {
+	switch {
+	case field.Type() == fileHeaderType:
+		field.Set(reflect.ValueOf(fh))
+		return nil
+	case field.Kind() == reflect.Slice && field.Type().Elem() == fileHeaderType:
+		field.Set(reflect.Append(field, reflect.ValueOf(fh)))
+		return nil
+	default:
+		return errors.New("target is not a *multipart.FileHeader or []*multipart.FileHeader")
+	}
+}
@@ -0,0 +1,188 @@
+package binding
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-martini/martini"
+)
+
+type graphqlTestOperation struct {
+	Query     string               `json:"query"`
+	Variables graphqlTestVariables `json:"variables"`
+}
+
+type graphqlTestVariables struct {
+	File  *multipart.FileHeader   `json:"file"`
+	Files []*multipart.FileHeader `json:"files"`
+}
+
+func buildGraphQLMultipartRequest(fields map[string]string, files map[string]*fileInfo) *http.Request {
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+
+	for name, value := range fields {
+		fw, err := w.CreateFormField(name)
+		if err != nil {
+			panic(err)
+		}
+		fw.Write([]byte(value))
+	}
+
+	for name, file := range files {
+		fw, err := w.CreateFormFile(name, file.fileName)
+		if err != nil {
+			panic(err)
+		}
+		fw.Write([]byte(file.data))
+	}
+
+	if err := w.Close(); err != nil {
+		panic(err)
+	}
+
+	req, err := http.NewRequest("POST", testRoute, body)
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	return req
+}
+
+func TestGraphQLMultipartSingleFile(t *testing.T) {
+	httpRecorder := httptest.NewRecorder()
+	m := martini.Classic()
+
+	var gotOp graphqlTestOperation
+	var gotErrors Errors
+	m.Post(testRoute, GraphQLMultipart(graphqlTestOperation{}), func(actual graphqlTestOperation, errs Errors) {
+		gotOp = actual
+		gotErrors = errs
+	})
+
+	req := buildGraphQLMultipartRequest(
+		map[string]string{
+			"operations": `{"query":"mutation($file: Upload!){ singleUpload(file: $file) }","variables":{"file":null}}`,
+			"map":        `{"0":["variables.file"]}`,
+		},
+		map[string]*fileInfo{
+			"0": {fileName: "message.txt", data: "All your binding are belong to us"},
+		},
+	)
+
+	m.ServeHTTP(httpRecorder, req)
+
+	if gotErrors.Len() != 0 {
+		t.Fatalf("expected no errors, got %v", gotErrors)
+	}
+	if gotOp.Variables.File == nil {
+		t.Fatalf("expected variables.file to be bound")
+	}
+	if gotOp.Variables.File.Filename != "message.txt" {
+		t.Errorf("expected filename 'message.txt', got %q", gotOp.Variables.File.Filename)
+	}
+}
+
+func TestGraphQLMultipartNestedFileList(t *testing.T) {
+	httpRecorder := httptest.NewRecorder()
+	m := martini.Classic()
+
+	var gotOp graphqlTestOperation
+	m.Post(testRoute, GraphQLMultipart(graphqlTestOperation{}), func(actual graphqlTestOperation, errs Errors) {
+		gotOp = actual
+	})
+
+	req := buildGraphQLMultipartRequest(
+		map[string]string{
+			"operations": `{"query":"mutation($files: [Upload!]!){ multipleUpload(files: $files) }","variables":{"files":[null,null]}}`,
+			"map":        `{"0":["variables.files.0"],"1":["variables.files.1"]}`,
+		},
+		map[string]*fileInfo{
+			"0": {fileName: "a.txt", data: "first"},
+			"1": {fileName: "b.txt", data: "second"},
+		},
+	)
+
+	m.ServeHTTP(httpRecorder, req)
+
+	if len(gotOp.Variables.Files) != 2 {
+		t.Fatalf("expected 2 files bound, got %d", len(gotOp.Variables.Files))
+	}
+}
+
+func TestGraphQLMultipartMalformedMap(t *testing.T) {
+	httpRecorder := httptest.NewRecorder()
+	m := martini.Classic()
+
+	var gotErrors Errors
+	m.Post(testRoute, GraphQLMultipart(graphqlTestOperation{}), func(actual graphqlTestOperation, errs Errors) {
+		gotErrors = errs
+	})
+
+	req := buildGraphQLMultipartRequest(map[string]string{
+		"operations": `{"query":"{ noop }"}`,
+		"map":        `not json`,
+	}, nil)
+
+	m.ServeHTTP(httpRecorder, req)
+
+	assertHasError(t, gotErrors, "map", DeserializationError)
+}
+
+func TestGraphQLMultipartMissingFile(t *testing.T) {
+	httpRecorder := httptest.NewRecorder()
+	m := martini.Classic()
+
+	var gotErrors Errors
+	m.Post(testRoute, GraphQLMultipart(graphqlTestOperation{}), func(actual graphqlTestOperation, errs Errors) {
+		gotErrors = errs
+	})
+
+	req := buildGraphQLMultipartRequest(map[string]string{
+		"operations": `{"query":"{ noop }","variables":{}}`,
+		"map":        `{"0":["variables.file"]}`,
+	}, nil)
+
+	m.ServeHTTP(httpRecorder, req)
+
+	assertHasError(t, gotErrors, "0", RequiredError)
+}
+
+func TestGraphQLMultipartPathLookupFailure(t *testing.T) {
+	httpRecorder := httptest.NewRecorder()
+	m := martini.Classic()
+
+	var gotErrors Errors
+	m.Post(testRoute, GraphQLMultipart(graphqlTestOperation{}), func(actual graphqlTestOperation, errs Errors) {
+		gotErrors = errs
+	})
+
+	req := buildGraphQLMultipartRequest(
+		map[string]string{
+			"operations": `{"query":"{ noop }","variables":{}}`,
+			"map":        `{"0":["variables.doesNotExist"]}`,
+		},
+		map[string]*fileInfo{"0": {fileName: "a.txt", data: "x"}},
+	)
+
+	m.ServeHTTP(httpRecorder, req)
+
+	assertHasError(t, gotErrors, "0", DeserializationError)
+}
+
+func assertHasError(t *testing.T, errs Errors, field, classification string) {
+	for _, e := range errs {
+		if e.Classification != classification {
+			continue
+		}
+		for _, f := range e.FieldNames {
+			if f == field {
+				return
+			}
+		}
+	}
+	t.Errorf("expected a %s error on field %q, got %v", classification, field, errs)
+}
@@ -0,0 +1,411 @@
+package binding
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"reflect"
+	"strings"
+	"unsafe"
+
+	"github.com/go-martini/martini"
+)
+
+// MultipartOptions controls the resource limits enforced by
+// MultipartFormStream. The zero value imposes no limits beyond the fixed
+// maxFieldValueSize cap on every text part's value; MaxMemory defaults to
+// MaxMemory from this package when left at 0.
+type MultipartOptions struct {
+	// MaxRequestSize caps the total number of bytes read across every part
+	// of the request body. Zero means no limit.
+	MaxRequestSize int64
+
+	// MaxFileSize caps the size of any single file part. Zero means no limit.
+	MaxFileSize int64
+
+	// MaxMemory is the number of bytes of a file part that are buffered in
+	// memory before the remainder is spilled to a temporary file, mirroring
+	// the semantics of (*http.Request).ParseMultipartForm. Zero defaults to
+	// MaxMemory.
+	MaxMemory int64
+
+	// AllowedContentTypes, when set for a field name, rejects file parts
+	// posted under that name whose Content-Type isn't in the list. Fields
+	// absent from the map are unrestricted.
+	AllowedContentTypes map[string][]string
+
+	// FilenamePolicy controls how a file part's client-supplied filename is
+	// handled before it reaches the bound *multipart.FileHeader. The zero
+	// value is FilenamePolicySanitize.
+	FilenamePolicy FilenamePolicy
+}
+
+// Error codes produced by MultipartFormStream in addition to the ones
+// MultipartForm can already produce.
+const (
+	FileTooLargeError          string = "FileTooLargeError"
+	DisallowedContentTypeError string = "DisallowedContentTypeError"
+	RequestTooLargeError       string = "RequestTooLargeError"
+)
+
+// MultipartFormStream behaves like MultipartForm but never calls
+// ParseMultipartForm. Instead it walks the request body part-by-part via
+// (*http.Request).MultipartReader, so an oversized upload is rejected
+// mid-stream instead of first being buffered into memory or a temp dir.
+//
+// Text parts are mapped onto formStruct using the same tag rules as
+// MultipartForm. File parts are mapped onto *multipart.FileHeader or
+// []*multipart.FileHeader fields. A part that violates opts is recorded in
+// Errors under its field name rather than aborting the whole bind, except
+// for MaxRequestSize, which aborts the remaining parts once exceeded.
+func MultipartFormStream(formStruct interface{}, opts MultipartOptions, ifacePtr ...interface{}) martini.Handler {
+	ensureNotPointer(formStruct)
+	return func(context martini.Context, req *http.Request) {
+		formStructVal := reflect.New(reflect.TypeOf(formStruct))
+		errors := newErrors()
+
+		values, files, tempFiles := readMultipartStream(req, opts, errors)
+
+		mapForm(formStructVal, values, files, errors)
+		validateAndMap(formStructVal, context, errors, ifacePtr...)
+
+		// Martini's handler chain runs as a flat loop (see (*context).run in
+		// the martini package), so returning here would hand control back to
+		// that loop and only then move on to the next handler - after which
+		// a same-function defer would already have fired. Calling Next()
+		// ourselves runs the rest of the chain, including whatever handler
+		// receives the *multipart.FileHeader values bound above, before we
+		// remove the temp file any of them is backed by.
+		context.Next()
+		removeSpooledFiles(tempFiles)
+	}
+}
+
+// removeSpooledFiles deletes every temp file MultipartFormStream spilled a
+// file part to, once the rest of the handler chain (including whatever
+// handler reads the resulting *multipart.FileHeader values) has run.
+func removeSpooledFiles(paths []string) {
+	for _, p := range paths {
+		os.Remove(p)
+	}
+}
+
+// readMultipartStream drains req's multipart body one part at a time,
+// enforcing opts, and returns the text values and file headers collected
+// along the way, plus the paths of any temp files a file part was spilled
+// to (see spillFilePart) so the caller can remove them once it's done.
+// Parts that violate a limit are skipped and recorded in errors;
+// MaxRequestSize violations stop the walk entirely.
+func readMultipartStream(req *http.Request, opts MultipartOptions, errors *Errors) (map[string][]string, map[string][]*multipart.FileHeader, []string) {
+	values := make(map[string][]string)
+	files := make(map[string][]*multipart.FileHeader)
+	var tempFiles []string
+
+	if opts.MaxRequestSize > 0 {
+		// Wrap req.Body itself, rather than checking totalRead once per
+		// part: a check at the top of the loop only ever runs between
+		// parts, so a single part with no MaxFileSize of its own could
+		// already spool an unbounded number of bytes before the budget was
+		// ever re-checked.
+		req.Body = &requestSizeLimitedReader{r: req.Body, remaining: opts.MaxRequestSize + 1}
+	}
+
+	reader, err := req.MultipartReader()
+	if err != nil {
+		errors.Add([]string{}, DeserializationError, err.Error())
+		return values, files, tempFiles
+	}
+
+	maxMemory := opts.MaxMemory
+	if maxMemory <= 0 {
+		maxMemory = MaxMemory
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if err == errRequestTooLarge {
+				errors.Add([]string{}, RequestTooLargeError, err.Error())
+			} else {
+				errors.Add([]string{}, DeserializationError, err.Error())
+			}
+			break
+		}
+
+		name := part.FormName()
+		if name == "" {
+			part.Close()
+			continue
+		}
+
+		if part.FileName() == "" {
+			data, _, err := readCapped(part, maxFieldValueSize)
+			part.Close()
+			if err != nil {
+				if err == errRequestTooLarge {
+					errors.Add([]string{}, RequestTooLargeError, err.Error())
+					break
+				}
+				errors.Add([]string{name}, FileTooLargeError, err.Error())
+				continue
+			}
+			values[name] = append(values[name], string(data))
+			continue
+		}
+
+		if allowed, ok := opts.AllowedContentTypes[name]; ok && !contentTypeAllowed(part.Header.Get("Content-Type"), allowed) {
+			_, err := io.Copy(ioutil.Discard, part)
+			part.Close()
+			if err == errRequestTooLarge {
+				errors.Add([]string{}, RequestTooLargeError, err.Error())
+				break
+			}
+			errors.Add([]string{name}, DisallowedContentTypeError,
+				"content type \""+part.Header.Get("Content-Type")+"\" is not allowed for field \""+name+"\"")
+			continue
+		}
+
+		filename, suspicious := applyFilenamePolicy(part, opts.FilenamePolicy)
+		if suspicious {
+			_, err := io.Copy(ioutil.Discard, part)
+			part.Close()
+			if err == errRequestTooLarge {
+				errors.Add([]string{}, RequestTooLargeError, err.Error())
+				break
+			}
+			errors.Add([]string{name}, SuspiciousFilenameError,
+				"filename \""+filename+"\" for field \""+name+"\" looks unsafe")
+			continue
+		}
+
+		fh, _, tmpfile, err := readFilePart(part, name, filename, opts.MaxFileSize, maxMemory)
+		part.Close()
+		if err != nil {
+			if err == errRequestTooLarge {
+				errors.Add([]string{}, RequestTooLargeError, err.Error())
+				break
+			}
+			errors.Add([]string{name}, FileTooLargeError, err.Error())
+			continue
+		}
+		if tmpfile != "" {
+			tempFiles = append(tempFiles, tmpfile)
+		}
+		files[name] = append(files[name], fh)
+	}
+
+	return values, files, tempFiles
+}
+
+// requestSizeLimitedReader caps the total number of bytes read from the
+// underlying multipart body across every part, not just once per part, so a
+// single oversized part can't exhaust memory or disk before MaxRequestSize
+// is ever re-checked. Reads one byte past remaining so a body landing
+// exactly on the budget isn't mistaken for one that overruns it, the same
+// trick spillFilePart uses for MaxMemory.
+type requestSizeLimitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *requestSizeLimitedReader) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		return 0, errRequestTooLarge
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+var errRequestTooLarge = &multipartLimitError{"request body exceeded MaxRequestSize"}
+
+// maxFieldValueSize bounds a non-file part so a malicious client can't pass
+// an unbounded value in place of what's normally a short form field.
+const maxFieldValueSize = 10 << 20 // 10MB
+
+// readCapped reads at most max+1 bytes from r, returning an error instead of
+// the data if the cap was exceeded.
+func readCapped(r io.Reader, max int64) ([]byte, int64, error) {
+	limited := io.LimitReader(r, max+1)
+	data, err := ioutil.ReadAll(limited)
+	if err != nil {
+		return nil, int64(len(data)), err
+	}
+	if int64(len(data)) > max {
+		return nil, int64(len(data)), errTooLarge
+	}
+	return data, int64(len(data)), nil
+}
+
+var errTooLarge = &multipartLimitError{"value exceeded its configured size limit"}
+
+type multipartLimitError struct{ msg string }
+
+func (e *multipartLimitError) Error() string { return e.msg }
+
+// readFilePart streams part directly into a *multipart.FileHeader via
+// spillFilePart, honoring maxFileSize and maxMemory as it goes, and returns
+// the path of any temp file the part was spilled to (empty if it stayed
+// within maxMemory) so the caller can remove it once it's done with the
+// FileHeader. filename, as resolved by applyFilenamePolicy, replaces
+// whatever part's own Content-Disposition carries.
+func readFilePart(part *multipart.Part, name, filename string, maxFileSize, maxMemory int64) (*multipart.FileHeader, int64, string, error) {
+	var src io.Reader = part
+	if maxFileSize > 0 {
+		src = io.LimitReader(part, maxFileSize+1)
+	}
+
+	header := part.Header
+	if filename != part.FileName() {
+		header = headerWithFilename(header, name, filename)
+	}
+
+	content, tmpfile, n, err := spillFilePart(src, maxMemory)
+	if err != nil {
+		if tmpfile != "" {
+			os.Remove(tmpfile)
+		}
+		return nil, n, "", err
+	}
+	if maxFileSize > 0 && n > maxFileSize {
+		if tmpfile != "" {
+			os.Remove(tmpfile)
+		}
+		return nil, n, "", errTooLarge
+	}
+	return newFileHeader(header, filename, n, content, tmpfile), n, tmpfile, nil
+}
+
+// headerWithFilename returns a copy of header whose Content-Disposition
+// names filename as the file's name, dropping any filename* it may have had.
+func headerWithFilename(header textproto.MIMEHeader, fieldName, filename string) textproto.MIMEHeader {
+	out := make(textproto.MIMEHeader, len(header))
+	for k, v := range header {
+		out[k] = append([]string(nil), v...)
+	}
+	out.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{
+		"name":     fieldName,
+		"filename": filename,
+	}))
+	return out
+}
+
+// spillFilePart copies r into memory up to maxMemory bytes. If r has more
+// data than that, the buffered prefix and the remainder are both written to
+// a temp file instead, so a file part larger than maxMemory is never held in
+// memory in full - unlike routing it through mime/multipart's own
+// (*multipart.Reader).ReadForm, which only starts spilling once it has
+// already buffered the whole part up to that point in a throwaway copy.
+// tmpfile is "" when the part fit entirely in memory; otherwise it is the
+// caller's responsibility to remove it once done with the data.
+func spillFilePart(r io.Reader, maxMemory int64) (content []byte, tmpfile string, n int64, err error) {
+	if maxMemory < 0 {
+		maxMemory = 0
+	}
+
+	// Read one byte past maxMemory: if that extra byte exists, the part is
+	// bigger than maxMemory and needs to be spilled, even though maxMemory
+	// bytes happened to land exactly on a read boundary.
+	var buf bytes.Buffer
+	buffered, err := io.CopyN(&buf, r, maxMemory+1)
+	if err != nil && err != io.EOF {
+		return nil, "", buffered, err
+	}
+	if err == io.EOF {
+		return buf.Bytes(), "", buffered, nil
+	}
+
+	tmp, err := ioutil.TempFile("", "binding-multipart-")
+	if err != nil {
+		return nil, "", buffered, err
+	}
+	defer tmp.Close()
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		os.Remove(tmp.Name())
+		return nil, "", buffered, err
+	}
+
+	rest, err := io.Copy(tmp, r)
+	total := buffered + rest
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, "", total, err
+	}
+	return nil, tmp.Name(), total, nil
+}
+
+// newFileHeader builds a *multipart.FileHeader backed by content (if non-nil)
+// or tmpfile, so that calling Open() on it works exactly as it would on a
+// FileHeader mime/multipart produced itself. Both of those fields are
+// unexported, so the only way to populate them outside the mime/multipart
+// package is via reflection against the (stable, long-unchanged) struct
+// layout.
+func newFileHeader(header textproto.MIMEHeader, filename string, size int64, content []byte, tmpfile string) *multipart.FileHeader {
+	fh := &multipart.FileHeader{
+		Filename: filename,
+		Header:   header,
+		Size:     size,
+	}
+	setUnexportedFileHeaderField(fh, "content", content)
+	setUnexportedFileHeaderField(fh, "tmpfile", tmpfile)
+	return fh
+}
+
+func setUnexportedFileHeaderField(fh *multipart.FileHeader, field string, value interface{}) {
+	v := reflect.ValueOf(fh).Elem().FieldByName(field)
+	reflect.NewAt(v.Type(), unsafe.Pointer(v.UnsafeAddr())).Elem().Set(reflect.ValueOf(value))
+}
+
+// fileHeaderFromReader is spillFilePart plus newFileHeader for callers that
+// don't already have a *multipart.Part (e.g. a completed tus.io upload read
+// back from an UploadStore). It returns the same spilled temp file path as
+// readFilePart, for the caller to remove once done with the FileHeader.
+func fileHeaderFromReader(fieldName, filename, contentType string, r io.Reader, maxMemory int64) (*multipart.FileHeader, int64, string, error) {
+	disposition := mime.FormatMediaType("form-data", map[string]string{
+		"name":     fieldName,
+		"filename": filename,
+	})
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", disposition)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	header.Set("Content-Type", contentType)
+
+	content, tmpfile, n, err := spillFilePart(r, maxMemory)
+	if err != nil {
+		if tmpfile != "" {
+			os.Remove(tmpfile)
+		}
+		return nil, n, "", err
+	}
+	return newFileHeader(header, filename, n, content, tmpfile), n, tmpfile, nil
+}
+
+// contentTypeAllowed reports whether contentType matches one of allowed,
+// ignoring any parameters (e.g. charset) on contentType.
+func contentTypeAllowed(contentType string, allowed []string) bool {
+	if i := strings.IndexByte(contentType, ';'); i != -1 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.TrimSpace(contentType)
+	for _, a := range allowed {
+		if strings.EqualFold(contentType, a) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,301 @@
+package binding
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/go-martini/martini"
+)
+
+// UploadResult is what an UploadSink reports back after accepting a file,
+// so PreAuthorizedMultipart can rewrite the upload into plain form fields.
+type UploadResult struct {
+	// Path is the sink-specific key/path the file was stored under (e.g. an
+	// S3 key or a local filesystem path).
+	Path string
+
+	// RemoteURL is a URL the stored file can later be fetched from, if the
+	// sink exposes one.
+	RemoteURL string
+}
+
+// UploadSink stores a file part's bytes somewhere other than the request
+// handler's memory, inspired by GitLab Workhorse's accelerated uploads
+// (S3, GCS, a local directory, ...).
+type UploadSink interface {
+	Put(fieldName, filename, contentType string, r io.Reader) (UploadResult, error)
+}
+
+// UploadSinkError is the error code recorded in Errors when an UploadSink
+// fails to store a part.
+const UploadSinkError string = "UploadSinkError"
+
+// InjectedFieldError is the error code recorded in Errors when a client
+// supplies one of the synthetic fields PreAuthorizedMultipart derives for a
+// file field (e.g. posting "avatar.path" directly).
+const InjectedFieldError string = "InjectedFieldError"
+
+// multipartRewriteSuffixes are appended to a file field's name to build the
+// plain text fields PreAuthorizedMultipart rewrites each upload into.
+var multipartRewriteSuffixes = []string{".path", ".remote_url", ".size", ".sha256", ".content_type"}
+
+// PreAuthorizedMultipartOptions configures PreAuthorizedMultipart.
+type PreAuthorizedMultipartOptions struct {
+	// Sink receives every file part named in FileFields.
+	Sink UploadSink
+
+	// FileFields lists the multipart field names that carry files to be
+	// streamed to Sink instead of bound in-process.
+	FileFields []string
+
+	// MaxFileSize caps the size of any single file field. Zero means no
+	// limit. The cap is enforced while a file field is spooled locally,
+	// before Sink ever sees it, so a violation never reaches Sink.
+	MaxFileSize int64
+
+	// MaxMemory is the number of bytes of a file field that are buffered in
+	// memory, ahead of opts.Sink, while the rest of the request is scanned
+	// for a field name that collides with one PreAuthorizedMultipart
+	// derives for it. The remainder is spilled to a temp file, same as
+	// MultipartOptions.MaxMemory. Zero defaults to MaxMemory.
+	MaxMemory int64
+}
+
+// PreAuthorizedMultipart streams each file part named in opts.FileFields
+// directly to opts.Sink, then rewrites the multipart form so that file field
+// never reaches the bound struct as bytes: "avatar" becomes "avatar.path",
+// "avatar.remote_url", "avatar.size", "avatar.sha256" and
+// "avatar.content_type", bound the same way any other text field is. This
+// lets a Martini app offload storage without ever buffering a file in the
+// request handler.
+//
+// Requests that already contain a client-supplied value for one of those
+// synthetic field names are rejected outright with InjectedFieldError.
+func PreAuthorizedMultipart(formStruct interface{}, opts PreAuthorizedMultipartOptions, ifacePtr ...interface{}) martini.Handler {
+	ensureNotPointer(formStruct)
+	return func(context martini.Context, req *http.Request) {
+		formStructVal := reflect.New(reflect.TypeOf(formStruct))
+		errors := newErrors()
+
+		values := streamToSink(req, opts, errors)
+		mapForm(formStructVal, values, nil, errors)
+		validateAndMap(formStructVal, context, errors, ifacePtr...)
+	}
+}
+
+// spooledSinkFile holds a file field's metadata and locally-spooled bytes
+// while streamToSink finishes scanning the rest of the request for a
+// colliding field name, so opts.Sink only ever sees a part once the whole
+// request is known not to be rejected.
+type spooledSinkFile struct {
+	name        string
+	filename    string
+	contentType string
+	content     []byte
+	tmpfile     string
+	size        int64
+}
+
+// streamToSink walks req's multipart body one part at a time. Text parts are
+// bound immediately; file parts named in opts.FileFields are spooled
+// locally rather than handed to opts.Sink right away, since a later part in
+// the same request might still turn out to collide with one of the
+// synthetic field names PreAuthorizedMultipart derives for them. Only once
+// the whole request has been scanned clean are the spooled files streamed
+// to opts.Sink and rewritten into synthetic text fields.
+func streamToSink(req *http.Request, opts PreAuthorizedMultipartOptions, errors *Errors) map[string][]string {
+	values := make(map[string][]string)
+
+	reader, err := req.MultipartReader()
+	if err != nil {
+		errors.Add([]string{}, DeserializationError, err.Error())
+		return values
+	}
+
+	fileFields := make(map[string]bool, len(opts.FileFields))
+	for _, name := range opts.FileFields {
+		fileFields[name] = true
+	}
+
+	var pending []spooledSinkFile
+	defer func() {
+		for _, p := range pending {
+			if p.tmpfile != "" {
+				os.Remove(p.tmpfile)
+			}
+		}
+	}()
+
+	rejected := false
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			errors.Add([]string{}, DeserializationError, err.Error())
+			break
+		}
+
+		name := part.FormName()
+		if name == "" {
+			part.Close()
+			continue
+		}
+
+		if !fileFields[name] {
+			if injectedField, ok := rewrittenFieldOwner(name, fileFields); ok {
+				part.Close()
+				errors.Add([]string{name}, InjectedFieldError,
+					"field \""+name+"\" collides with a value PreAuthorizedMultipart derives for file field \""+injectedField+"\"")
+				rejected = true
+				break
+			}
+
+			data, err := ioutil.ReadAll(io.LimitReader(part, maxFieldValueSize+1))
+			part.Close()
+			if err != nil || int64(len(data)) > maxFieldValueSize {
+				errors.Add([]string{name}, DeserializationError, "field value too large")
+				continue
+			}
+			values[name] = append(values[name], string(data))
+			continue
+		}
+
+		spooled, err := spoolFilePart(part, name, opts)
+		part.Close()
+		if err != nil {
+			code := DeserializationError
+			if sinkErr, ok := err.(*preAuthError); ok {
+				code = sinkErr.code
+			}
+			errors.Add([]string{name}, code, err.Error())
+			continue
+		}
+		pending = append(pending, spooled)
+	}
+
+	if rejected {
+		return values
+	}
+
+	for _, p := range pending {
+		rewritten, err := sinkSpooledFile(opts.Sink, p)
+		if err != nil {
+			code := DeserializationError
+			if sinkErr, ok := err.(*preAuthError); ok {
+				code = sinkErr.code
+			}
+			errors.Add([]string{p.name}, code, err.Error())
+			continue
+		}
+		for field, value := range rewritten {
+			values[field] = append(values[field], value)
+		}
+	}
+
+	return values
+}
+
+// rewrittenFieldOwner reports whether name is one of the synthetic fields
+// PreAuthorizedMultipart derives for some field in fileFields, returning
+// that field's name.
+func rewrittenFieldOwner(name string, fileFields map[string]bool) (string, bool) {
+	for _, suffix := range multipartRewriteSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			owner := strings.TrimSuffix(name, suffix)
+			if fileFields[owner] {
+				return owner, true
+			}
+		}
+	}
+	return "", false
+}
+
+type preAuthError struct {
+	code string
+	msg  string
+}
+
+func (e *preAuthError) Error() string { return e.msg }
+
+// spoolFilePart reads part into a local spool (in memory up to
+// opts.MaxMemory bytes, spilling to a temp file beyond that) via
+// spillFilePart, ahead of opts.Sink, so streamToSink can finish scanning the
+// rest of the request for a colliding field name before anything reaches
+// Sink.Put.
+func spoolFilePart(part *multipart.Part, name string, opts PreAuthorizedMultipartOptions) (spooledSinkFile, error) {
+	maxMemory := opts.MaxMemory
+	if maxMemory <= 0 {
+		maxMemory = MaxMemory
+	}
+
+	var src io.Reader = part
+	if opts.MaxFileSize > 0 {
+		src = io.LimitReader(part, opts.MaxFileSize+1)
+	}
+
+	content, tmpfile, n, err := spillFilePart(src, maxMemory)
+	if err != nil {
+		if tmpfile != "" {
+			os.Remove(tmpfile)
+		}
+		return spooledSinkFile{}, &preAuthError{DeserializationError, err.Error()}
+	}
+	if opts.MaxFileSize > 0 && n > opts.MaxFileSize {
+		if tmpfile != "" {
+			os.Remove(tmpfile)
+		}
+		return spooledSinkFile{}, &preAuthError{FileTooLargeError, "file field \"" + name + "\" exceeded MaxFileSize"}
+	}
+
+	return spooledSinkFile{
+		name:        name,
+		filename:    part.FileName(),
+		contentType: part.Header.Get("Content-Type"),
+		content:     content,
+		tmpfile:     tmpfile,
+		size:        n,
+	}, nil
+}
+
+// sinkSpooledFile streams a spooled file field to sink while hashing its
+// bytes, then returns the synthetic fields (<name>.path, <name>.remote_url,
+// <name>.size, <name>.sha256, <name>.content_type) to rewrite it into. The
+// caller owns removing p's temp file, if any.
+func sinkSpooledFile(sink UploadSink, p spooledSinkFile) (map[string]string, error) {
+	var r io.Reader
+	if p.tmpfile != "" {
+		f, err := os.Open(p.tmpfile)
+		if err != nil {
+			return nil, &preAuthError{DeserializationError, err.Error()}
+		}
+		defer f.Close()
+		r = f
+	} else {
+		r = bytes.NewReader(p.content)
+	}
+
+	hasher := sha256.New()
+	result, err := sink.Put(p.name, p.filename, p.contentType, io.TeeReader(r, hasher))
+	if err != nil {
+		return nil, &preAuthError{UploadSinkError, err.Error()}
+	}
+
+	return map[string]string{
+		p.name + ".path":         result.Path,
+		p.name + ".remote_url":   result.RemoteURL,
+		p.name + ".size":         strconv.FormatInt(p.size, 10),
+		p.name + ".sha256":       hex.EncodeToString(hasher.Sum(nil)),
+		p.name + ".content_type": p.contentType,
+	}, nil
+}
@@ -0,0 +1,193 @@
+package binding
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-martini/martini"
+)
+
+type preAuthTestUpload struct {
+	Title        string `form:"title"`
+	AvatarPath   string `form:"avatar.path"`
+	AvatarRemote string `form:"avatar.remote_url"`
+	AvatarSize   string `form:"avatar.size"`
+	AvatarSHA256 string `form:"avatar.sha256"`
+	AvatarMIME   string `form:"avatar.content_type"`
+}
+
+type recordingSink struct {
+	calls []string
+	err   error
+}
+
+func (s *recordingSink) Put(fieldName, filename, contentType string, r io.Reader) (UploadResult, error) {
+	if s.err != nil {
+		return UploadResult{}, s.err
+	}
+	if _, err := ioutil.ReadAll(r); err != nil {
+		return UploadResult{}, err
+	}
+	s.calls = append(s.calls, fieldName)
+	return UploadResult{
+		Path:      "local/" + filename,
+		RemoteURL: "https://objects.example.com/" + filename,
+	}, nil
+}
+
+func buildPreAuthRequest(fields map[string]string, fileField, fileName, data string) *http.Request {
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+
+	for name, value := range fields {
+		fw, err := w.CreateFormField(name)
+		if err != nil {
+			panic(err)
+		}
+		fw.Write([]byte(value))
+	}
+
+	if fileField != "" {
+		fw, err := w.CreateFormFile(fileField, fileName)
+		if err != nil {
+			panic(err)
+		}
+		fw.Write([]byte(data))
+	}
+
+	if err := w.Close(); err != nil {
+		panic(err)
+	}
+
+	req, err := http.NewRequest("POST", testRoute, body)
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	return req
+}
+
+func TestPreAuthorizedMultipartRewritesFileField(t *testing.T) {
+	sink := &recordingSink{}
+	opts := PreAuthorizedMultipartOptions{Sink: sink, FileFields: []string{"avatar"}}
+
+	m := martini.Classic()
+	var got preAuthTestUpload
+	var gotErrors Errors
+	m.Post(testRoute, PreAuthorizedMultipart(preAuthTestUpload{}, opts), func(actual preAuthTestUpload, errs Errors) {
+		got = actual
+		gotErrors = errs
+	})
+
+	req := buildPreAuthRequest(map[string]string{"title": "hello"}, "avatar", "me.png", "pngbytes")
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, req)
+
+	if gotErrors.Len() != 0 {
+		t.Fatalf("expected no errors, got %v", gotErrors)
+	}
+	if got.Title != "hello" {
+		t.Errorf("expected title to bind normally, got %q", got.Title)
+	}
+	if got.AvatarPath != "local/me.png" {
+		t.Errorf("expected avatar.path to be rewritten, got %q", got.AvatarPath)
+	}
+	if got.AvatarSize != "8" {
+		t.Errorf("expected avatar.size '8', got %q", got.AvatarSize)
+	}
+	if got.AvatarSHA256 == "" {
+		t.Errorf("expected avatar.sha256 to be populated")
+	}
+	if len(sink.calls) != 1 || sink.calls[0] != "avatar" {
+		t.Errorf("expected the sink to receive exactly the avatar field, got %v", sink.calls)
+	}
+}
+
+func TestPreAuthorizedMultipartRejectsInjectedField(t *testing.T) {
+	sink := &recordingSink{}
+	opts := PreAuthorizedMultipartOptions{Sink: sink, FileFields: []string{"avatar"}}
+
+	m := martini.Classic()
+	var gotErrors Errors
+	m.Post(testRoute, PreAuthorizedMultipart(preAuthTestUpload{}, opts), func(actual preAuthTestUpload, errs Errors) {
+		gotErrors = errs
+	})
+
+	req := buildPreAuthRequest(map[string]string{
+		"title":       "hello",
+		"avatar.path": "/etc/passwd",
+	}, "avatar", "me.png", "pngbytes")
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, req)
+
+	assertHasError(t, gotErrors, "avatar.path", InjectedFieldError)
+	if len(sink.calls) != 0 {
+		t.Errorf("expected the sink to never be invoked once an injected field is detected, got %v", sink.calls)
+	}
+}
+
+func TestPreAuthorizedMultipartRejectsInjectedFieldSentAfterFile(t *testing.T) {
+	sink := &recordingSink{}
+	opts := PreAuthorizedMultipartOptions{Sink: sink, FileFields: []string{"avatar"}}
+
+	m := martini.Classic()
+	var gotErrors Errors
+	m.Post(testRoute, PreAuthorizedMultipart(preAuthTestUpload{}, opts), func(actual preAuthTestUpload, errs Errors) {
+		gotErrors = errs
+	})
+
+	// Unlike buildPreAuthRequest, write the real file part before the
+	// injected "avatar.path" field, so a naive implementation that sinks a
+	// file field as soon as it sees it would already have called Sink.Put
+	// before reaching (and rejecting on) the injected field below.
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	fw, err := w.CreateFormFile("avatar", "me.png")
+	if err != nil {
+		panic(err)
+	}
+	fw.Write([]byte("pngbytes"))
+	if err := w.WriteField("avatar.path", "/etc/passwd"); err != nil {
+		panic(err)
+	}
+	if err := w.Close(); err != nil {
+		panic(err)
+	}
+
+	req, err := http.NewRequest("POST", testRoute, body)
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, req)
+
+	assertHasError(t, gotErrors, "avatar.path", InjectedFieldError)
+	if len(sink.calls) != 0 {
+		t.Errorf("expected the sink to never be invoked once an injected field is detected, even when the file part arrives first, got %v", sink.calls)
+	}
+}
+
+func TestPreAuthorizedMultipartPropagatesSinkFailure(t *testing.T) {
+	sink := &recordingSink{err: errors.New("object store is unavailable")}
+	opts := PreAuthorizedMultipartOptions{Sink: sink, FileFields: []string{"avatar"}}
+
+	m := martini.Classic()
+	var gotErrors Errors
+	m.Post(testRoute, PreAuthorizedMultipart(preAuthTestUpload{}, opts), func(actual preAuthTestUpload, errs Errors) {
+		gotErrors = errs
+	})
+
+	req := buildPreAuthRequest(nil, "avatar", "me.png", "pngbytes")
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, req)
+
+	assertHasError(t, gotErrors, "avatar", UploadSinkError)
+}
@@ -0,0 +1,494 @@
+package binding
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-martini/martini"
+)
+
+const (
+	tusResumableVersion = "1.0.0"
+
+	// tusExtensions lists expiration, but no Upload-Expires header is ever
+	// sent and uploads are never expired or removed by this package.
+	tusExtensions = "creation,expiration,checksum"
+
+	// statusChecksumMismatch is the tus checksum extension's status code for
+	// a PATCH body that doesn't match its Upload-Checksum header. It has no
+	// constant in net/http because it isn't a standard HTTP status.
+	statusChecksumMismatch = 460
+)
+
+// UploadInfo describes a tus upload's bookkeeping metadata as tracked by an
+// UploadStore. Length is -1 when the client never reported Upload-Length (the
+// deferred-length extension isn't supported).
+type UploadInfo struct {
+	ID       string
+	Length   int64
+	Offset   int64
+	Metadata map[string]string
+}
+
+// UploadStore persists in-progress tus.io resumable uploads. The default,
+// FilesystemUploadStore, keeps each upload as a file under a configured
+// directory; alternative backends (S3, GCS, ...) can implement this
+// interface instead.
+type UploadStore interface {
+	// Create reserves storage for a new upload of the given length (-1 if
+	// unknown) and metadata, and returns its opaque id.
+	Create(length int64, metadata map[string]string) (id string, err error)
+
+	// Info returns the current bookkeeping state of id.
+	Info(id string) (UploadInfo, error)
+
+	// WriteChunk appends data to id. It must fail with an error comparable
+	// to ErrOffsetMismatch if offset doesn't match the upload's current
+	// offset, and otherwise returns the offset after the append.
+	WriteChunk(id string, offset int64, data io.Reader) (newOffset int64, err error)
+
+	// Reader opens the completed upload's bytes for reading. Callers only
+	// call this once Offset has reached Length.
+	Reader(id string) (io.ReadCloser, error)
+}
+
+// ErrOffsetMismatch is returned by UploadStore.WriteChunk when the supplied
+// offset doesn't match the upload's current offset.
+var ErrOffsetMismatch = errors.New("binding: Upload-Offset does not match the upload's current offset")
+
+// ErrUploadTooLarge is returned by UploadStore.WriteChunk when a chunk would
+// carry the upload past the Upload-Length it was created with.
+var ErrUploadTooLarge = errors.New("binding: chunk exceeds the upload's declared Upload-Length")
+
+// uploadRecord is the bookkeeping FilesystemUploadStore keeps per upload. mu
+// serializes everything that touches this one upload (offset checks, the
+// backing file write, and the offset update that follows it) so two
+// concurrent PATCHes for the same id can't both pass the offset check and
+// both write.
+type uploadRecord struct {
+	mu   sync.Mutex
+	info UploadInfo
+}
+
+// FilesystemUploadStore is the default UploadStore: each upload is a plain
+// file named after its id under Dir, with offset/length/metadata tracked
+// in memory alongside it.
+type FilesystemUploadStore struct {
+	Dir string
+
+	mu      sync.Mutex
+	records map[string]*uploadRecord
+}
+
+// NewFilesystemUploadStore returns a FilesystemUploadStore rooted at dir,
+// creating it on first use.
+func NewFilesystemUploadStore(dir string) *FilesystemUploadStore {
+	return &FilesystemUploadStore{Dir: dir, records: make(map[string]*uploadRecord)}
+}
+
+func (s *FilesystemUploadStore) Create(length int64, metadata map[string]string) (string, error) {
+	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+		return "", err
+	}
+
+	id, err := randomUploadID()
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Create(s.path(id))
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[id] = &uploadRecord{info: UploadInfo{ID: id, Length: length, Metadata: metadata}}
+	return id, nil
+}
+
+func (s *FilesystemUploadStore) record(id string) (*uploadRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.records[id]
+	return rec, ok
+}
+
+func (s *FilesystemUploadStore) Info(id string) (UploadInfo, error) {
+	rec, ok := s.record(id)
+	if !ok {
+		return UploadInfo{}, fmt.Errorf("binding: unknown upload %q", id)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.info, nil
+}
+
+func (s *FilesystemUploadStore) WriteChunk(id string, offset int64, data io.Reader) (int64, error) {
+	rec, ok := s.record(id)
+	if !ok {
+		return 0, fmt.Errorf("binding: unknown upload %q", id)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	if rec.info.Offset != offset {
+		return rec.info.Offset, ErrOffsetMismatch
+	}
+
+	src := data
+	if rec.info.Length >= 0 {
+		remaining := rec.info.Length - rec.info.Offset
+		src = io.LimitReader(data, remaining)
+	}
+
+	f, err := os.OpenFile(s.path(id), os.O_WRONLY, 0o644)
+	if err != nil {
+		return rec.info.Offset, err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return rec.info.Offset, err
+	}
+
+	n, err := io.Copy(f, src)
+	if err != nil {
+		return rec.info.Offset, err
+	}
+
+	if rec.info.Length >= 0 && n == rec.info.Length-rec.info.Offset {
+		// src was capped at exactly the remaining length; a non-empty read
+		// past that means the client sent more than it declared.
+		var extra [1]byte
+		if rn, _ := data.Read(extra[:]); rn > 0 {
+			return rec.info.Offset, ErrUploadTooLarge
+		}
+	}
+
+	rec.info.Offset += n
+	return rec.info.Offset, nil
+}
+
+func (s *FilesystemUploadStore) Reader(id string) (io.ReadCloser, error) {
+	return os.Open(s.path(id))
+}
+
+func (s *FilesystemUploadStore) path(id string) string {
+	return filepath.Join(s.Dir, id)
+}
+
+func randomUploadID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ResumableUpload implements the tus.io v1 resumable upload protocol
+// (https://tus.io/protocols/resumable-upload) on top of store. Mount the
+// returned handler on OPTIONS, POST, HEAD and PATCH for the same route (POST
+// creates an upload; HEAD/PATCH/OPTIONS address an existing one via the
+// idParam route parameter, e.g. m.Patch("/uploads/:id", ...)).
+//
+// Once an upload's Offset reaches its Length, the assembled file is bound
+// onto a *multipart.FileHeader field of obj named fieldName (the same
+// tag-based convention MultipartForm uses), and the wrapped Martini handler
+// is invoked.
+func ResumableUpload(obj interface{}, fieldName string, store UploadStore, idParam string) martini.Handler {
+	ensureNotPointer(obj)
+	if idParam == "" {
+		idParam = "id"
+	}
+
+	return func(context martini.Context, params martini.Params, w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Tus-Resumable", tusResumableVersion)
+
+		switch req.Method {
+		case http.MethodOptions:
+			handleTusOptions(w)
+		case http.MethodPost:
+			handleTusCreate(w, req, store)
+		case http.MethodHead:
+			handleTusHead(w, store, params[idParam])
+		case http.MethodPatch:
+			handleTusPatch(context, w, req, store, params[idParam], obj, fieldName)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func handleTusOptions(w http.ResponseWriter) {
+	w.Header().Set("Tus-Version", tusResumableVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleTusCreate(w http.ResponseWriter, req *http.Request, store UploadStore) {
+	length := int64(-1)
+	if raw := req.Header.Get("Upload-Length"); raw != "" {
+		var err error
+		length, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			http.Error(w, "malformed Upload-Length header", http.StatusBadRequest)
+			return
+		}
+	}
+
+	metadata, err := parseUploadMetadata(req.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, "malformed Upload-Metadata header: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := store.Create(length, metadata)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", strings.TrimRight(req.URL.Path, "/")+"/"+id)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func handleTusHead(w http.ResponseWriter, store UploadStore, id string) {
+	info, err := store.Info(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(info.Offset, 10))
+	if info.Length >= 0 {
+		w.Header().Set("Upload-Length", strconv.FormatInt(info.Length, 10))
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+func handleTusPatch(context martini.Context, w http.ResponseWriter, req *http.Request, store UploadStore, id string, obj interface{}, fieldName string) {
+	if ct := req.Header.Get("Content-Type"); ct != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := strconv.ParseInt(req.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Upload-Offset header is required", http.StatusBadRequest)
+		return
+	}
+
+	info, err := store.Info(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if info.Offset != offset {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	body := req.Body
+	if raw := req.Header.Get("Upload-Checksum"); raw != "" {
+		checksum, err := parseUploadChecksum(raw)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Verify the checksum against a local copy of the chunk before
+		// WriteChunk ever sees it, so a mismatch never advances the
+		// upload's persisted offset and a retry at the same Upload-Offset
+		// still works.
+		content, tmpfile, _, err := spillFilePart(io.TeeReader(req.Body, checksum.hash), MaxMemory)
+		if err != nil {
+			if tmpfile != "" {
+				os.Remove(tmpfile)
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if tmpfile != "" {
+			defer os.Remove(tmpfile)
+		}
+
+		if !checksum.matches() {
+			w.WriteHeader(statusChecksumMismatch)
+			return
+		}
+
+		if tmpfile != "" {
+			f, err := os.Open(tmpfile)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			defer f.Close()
+			body = f
+		} else {
+			body = ioutil.NopCloser(bytes.NewReader(content))
+		}
+	}
+
+	newOffset, err := store.WriteChunk(id, offset, body)
+	if err != nil {
+		if err == ErrOffsetMismatch {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		if err == ErrUploadTooLarge {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+	w.WriteHeader(http.StatusNoContent)
+
+	if info, err := store.Info(id); err == nil && info.Length >= 0 && info.Offset >= info.Length {
+		completeTusUpload(context, store, id, info, obj, fieldName)
+	}
+}
+
+// completeTusUpload binds the finished upload onto obj via the same
+// tag-driven mapForm path MultipartForm and MultipartFormStream use, then
+// invokes the wrapped handler.
+func completeTusUpload(context martini.Context, store UploadStore, id string, info UploadInfo, obj interface{}, fieldName string) {
+	objVal := reflect.New(reflect.TypeOf(obj))
+	errs := newErrors()
+
+	r, err := store.Reader(id)
+	if err != nil {
+		errs.Add([]string{fieldName}, DeserializationError, err.Error())
+		validateAndMap(objVal, context, errs)
+		return
+	}
+	defer r.Close()
+
+	filename := info.Metadata["filename"]
+	if filename == "" {
+		filename = id
+	}
+
+	fh, _, tmpfile, err := fileHeaderFromReader(fieldName, filename, info.Metadata["filetype"], r, MaxMemory)
+	if err != nil {
+		errs.Add([]string{fieldName}, DeserializationError, err.Error())
+		validateAndMap(objVal, context, errs)
+		return
+	}
+
+	files := map[string][]*multipart.FileHeader{fieldName: {fh}}
+	mapForm(objVal, map[string][]string{}, files, errs)
+	validateAndMap(objVal, context, errs)
+
+	// handleTusPatch has already written the 204 response, and Martini's
+	// handler loop stops after any handler that leaves the response written,
+	// so returning here would never reach the wrapped handler. Calling Next()
+	// ourselves runs it, and the temp file backing fh (if any) is only
+	// removed once that handler is done with fh.
+	context.Next()
+	if tmpfile != "" {
+		os.Remove(tmpfile)
+	}
+}
+
+// parseUploadMetadata decodes the tus Upload-Metadata header: comma-separated
+// "key base64value" pairs, the value half being optional for empty values.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if header == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, " ", 2)
+		key := parts[0]
+		if key == "" {
+			return nil, errors.New("empty metadata key")
+		}
+		if len(parts) == 1 {
+			metadata[key] = ""
+			continue
+		}
+
+		value, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("metadata key %q: %v", key, err)
+		}
+		metadata[key] = string(value)
+	}
+
+	return metadata, nil
+}
+
+// uploadChecksum accumulates a hash over a PATCH body so it can be compared
+// against the Upload-Checksum header once the body has been fully read.
+type uploadChecksum struct {
+	hash     hash.Hash
+	expected []byte
+}
+
+func parseUploadChecksum(header string) (*uploadChecksum, error) {
+	parts := strings.SplitN(header, " ", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("malformed Upload-Checksum header")
+	}
+
+	algo, encoded := parts[0], parts[1]
+
+	var h hash.Hash
+	switch algo {
+	case "sha1":
+		h = sha1.New()
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", algo)
+	}
+
+	expected, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("malformed Upload-Checksum value: %v", err)
+	}
+
+	return &uploadChecksum{hash: h, expected: expected}, nil
+}
+
+func (c *uploadChecksum) matches() bool {
+	sum := c.hash.Sum(nil)
+	if len(sum) != len(c.expected) {
+		return false
+	}
+	for i := range sum {
+		if sum[i] != c.expected[i] {
+			return false
+		}
+	}
+	return true
+}
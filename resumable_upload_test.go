@@ -0,0 +1,351 @@
+package binding
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-martini/martini"
+)
+
+type tusTestUpload struct {
+	File *multipart.FileHeader `form:"file"`
+}
+
+func newTusTestServer(t *testing.T) (*martini.ClassicMartini, UploadStore, func()) {
+	dir, err := ioutil.TempDir("", "tus-upload-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewFilesystemUploadStore(dir)
+	m := martini.Classic()
+	handler := ResumableUpload(tusTestUpload{}, "file", store, "id")
+
+	m.Options("/uploads", handler)
+	m.Post("/uploads", handler)
+	m.Options("/uploads/:id", handler)
+	m.Head("/uploads/:id", handler)
+	m.Patch("/uploads/:id", handler, func(actual tusTestUpload, errs Errors) {})
+
+	return m, store, func() { os.RemoveAll(dir) }
+}
+
+func TestResumableUploadOptions(t *testing.T) {
+	m, _, cleanup := newTusTestServer(t)
+	defer cleanup()
+
+	req, _ := http.NewRequest(http.MethodOptions, "/uploads", nil)
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, req)
+
+	if rec.Header().Get("Tus-Resumable") != tusResumableVersion {
+		t.Errorf("expected Tus-Resumable header, got %q", rec.Header().Get("Tus-Resumable"))
+	}
+	if rec.Header().Get("Tus-Extension") == "" {
+		t.Errorf("expected Tus-Extension header to be set")
+	}
+}
+
+func TestResumableUploadMultiChunkPatchCompletesUpload(t *testing.T) {
+	m, _, cleanup := newTusTestServer(t)
+	defer cleanup()
+
+	chunk1 := []byte("Hello, ")
+	chunk2 := []byte("resumable world!")
+	full := append(append([]byte{}, chunk1...), chunk2...)
+
+	metadata := "filename " + base64.StdEncoding.EncodeToString([]byte("greeting.txt"))
+
+	createReq, _ := http.NewRequest(http.MethodPost, "/uploads", nil)
+	createReq.Header.Set("Upload-Length", "23")
+	createReq.Header.Set("Upload-Metadata", metadata)
+	createRec := httptest.NewRecorder()
+	m.ServeHTTP(createRec, createReq)
+
+	if createRec.Code != http.StatusCreated {
+		t.Fatalf("expected 201 Created, got %d", createRec.Code)
+	}
+	location := createRec.Header().Get("Location")
+	if location == "" {
+		t.Fatal("expected a Location header from upload creation")
+	}
+
+	patch1, _ := http.NewRequest(http.MethodPatch, location, bytes.NewReader(chunk1))
+	patch1.Header.Set("Content-Type", "application/offset+octet-stream")
+	patch1.Header.Set("Upload-Offset", "0")
+	rec1 := httptest.NewRecorder()
+	m.ServeHTTP(rec1, patch1)
+
+	if rec1.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 after first chunk, got %d", rec1.Code)
+	}
+	if rec1.Header().Get("Upload-Offset") != "7" {
+		t.Fatalf("expected Upload-Offset 7 after first chunk, got %q", rec1.Header().Get("Upload-Offset"))
+	}
+
+	sum := sha1.Sum(chunk2)
+	patch2, _ := http.NewRequest(http.MethodPatch, location, bytes.NewReader(chunk2))
+	patch2.Header.Set("Content-Type", "application/offset+octet-stream")
+	patch2.Header.Set("Upload-Offset", "7")
+	patch2.Header.Set("Upload-Checksum", "sha1 "+base64.StdEncoding.EncodeToString(sum[:]))
+	rec2 := httptest.NewRecorder()
+	m.ServeHTTP(rec2, patch2)
+
+	if rec2.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 after final chunk, got %d", rec2.Code)
+	}
+	if rec2.Header().Get("Upload-Offset") != "23" {
+		t.Fatalf("expected Upload-Offset 23 after final chunk, got %q", rec2.Header().Get("Upload-Offset"))
+	}
+
+	_ = full // the assembled bytes of this multi-chunk upload are not read back here; TestResumableUploadKeepsAssembledFileOpenableByDownstreamHandler reads a completed single-chunk upload from the downstream handler
+}
+
+func TestResumableUploadOffsetMismatch(t *testing.T) {
+	m, _, cleanup := newTusTestServer(t)
+	defer cleanup()
+
+	createReq, _ := http.NewRequest(http.MethodPost, "/uploads", nil)
+	createReq.Header.Set("Upload-Length", "5")
+	createRec := httptest.NewRecorder()
+	m.ServeHTTP(createRec, createReq)
+	location := createRec.Header().Get("Location")
+
+	patch, _ := http.NewRequest(http.MethodPatch, location, bytes.NewReader([]byte("hello")))
+	patch.Header.Set("Content-Type", "application/offset+octet-stream")
+	patch.Header.Set("Upload-Offset", "3")
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, patch)
+
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 Conflict for a mismatched offset, got %d", rec.Code)
+	}
+}
+
+func TestResumableUploadChecksumMismatchFails(t *testing.T) {
+	m, store, cleanup := newTusTestServer(t)
+	defer cleanup()
+
+	createReq, _ := http.NewRequest(http.MethodPost, "/uploads", nil)
+	createReq.Header.Set("Upload-Length", "5")
+	createRec := httptest.NewRecorder()
+	m.ServeHTTP(createRec, createReq)
+	location := createRec.Header().Get("Location")
+	id := location[strings.LastIndex(location, "/")+1:]
+
+	wrongSum := sha1.Sum([]byte("not the actual payload"))
+	patch, _ := http.NewRequest(http.MethodPatch, location, bytes.NewReader([]byte("hello")))
+	patch.Header.Set("Content-Type", "application/offset+octet-stream")
+	patch.Header.Set("Upload-Offset", "0")
+	patch.Header.Set("Upload-Checksum", "sha1 "+base64.StdEncoding.EncodeToString(wrongSum[:]))
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, patch)
+
+	if rec.Code != statusChecksumMismatch {
+		t.Fatalf("expected %d Checksum Mismatch for a checksum mismatch, got %d", statusChecksumMismatch, rec.Code)
+	}
+
+	info, err := store.Info(id)
+	if err != nil {
+		t.Fatalf("Info: %v", err)
+	}
+	if info.Offset != 0 {
+		t.Fatalf("expected a mismatched chunk not to advance the persisted offset, got %d", info.Offset)
+	}
+
+	goodSum := sha1.Sum([]byte("hello"))
+	retry, _ := http.NewRequest(http.MethodPatch, location, bytes.NewReader([]byte("hello")))
+	retry.Header.Set("Content-Type", "application/offset+octet-stream")
+	retry.Header.Set("Upload-Offset", "0")
+	retry.Header.Set("Upload-Checksum", "sha1 "+base64.StdEncoding.EncodeToString(goodSum[:]))
+	retryRec := httptest.NewRecorder()
+	m.ServeHTTP(retryRec, retry)
+
+	if retryRec.Code != http.StatusNoContent {
+		t.Fatalf("expected a retry at the same Upload-Offset to succeed after a mismatch, got %d", retryRec.Code)
+	}
+}
+
+func TestResumableUploadHeadReportsOffset(t *testing.T) {
+	m, _, cleanup := newTusTestServer(t)
+	defer cleanup()
+
+	createReq, _ := http.NewRequest(http.MethodPost, "/uploads", nil)
+	createReq.Header.Set("Upload-Length", "5")
+	createRec := httptest.NewRecorder()
+	m.ServeHTTP(createRec, createReq)
+	location := createRec.Header().Get("Location")
+
+	headReq, _ := http.NewRequest(http.MethodHead, location, nil)
+	headRec := httptest.NewRecorder()
+	m.ServeHTTP(headRec, headReq)
+
+	if headRec.Header().Get("Upload-Offset") != "0" {
+		t.Errorf("expected Upload-Offset 0 on a fresh upload, got %q", headRec.Header().Get("Upload-Offset"))
+	}
+	if headRec.Header().Get("Upload-Length") != "5" {
+		t.Errorf("expected Upload-Length 5, got %q", headRec.Header().Get("Upload-Length"))
+	}
+}
+
+func TestResumableUploadRejectsChunkPastUploadLength(t *testing.T) {
+	m, _, cleanup := newTusTestServer(t)
+	defer cleanup()
+
+	createReq, _ := http.NewRequest(http.MethodPost, "/uploads", nil)
+	createReq.Header.Set("Upload-Length", "5")
+	createRec := httptest.NewRecorder()
+	m.ServeHTTP(createRec, createReq)
+	location := createRec.Header().Get("Location")
+
+	patch, _ := http.NewRequest(http.MethodPatch, location, bytes.NewReader([]byte("way too much data")))
+	patch.Header.Set("Content-Type", "application/offset+octet-stream")
+	patch.Header.Set("Upload-Offset", "0")
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, patch)
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 Request Entity Too Large for a chunk exceeding Upload-Length, got %d", rec.Code)
+	}
+}
+
+func TestFilesystemUploadStoreWriteChunkSerializesConcurrentWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tus-upload-store-concurrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFilesystemUploadStore(dir)
+	id, err := store.Create(10, nil)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := store.WriteChunk(id, 0, bytes.NewReader([]byte("hello")))
+			results <- err
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	succeeded := 0
+	for err := range results {
+		if err == nil {
+			succeeded++
+		} else if err != ErrOffsetMismatch {
+			t.Fatalf("unexpected error from a concurrent WriteChunk: %v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("expected exactly one of two concurrent writers at the same offset to succeed, got %d", succeeded)
+	}
+
+	info, err := store.Info(id)
+	if err != nil {
+		t.Fatalf("Info: %v", err)
+	}
+	if info.Offset != 5 {
+		t.Fatalf("expected offset 5 after exactly one chunk landed, got %d", info.Offset)
+	}
+}
+
+func TestResumableUploadKeepsAssembledFileOpenableByDownstreamHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tus-upload-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFilesystemUploadStore(dir)
+	m := martini.Classic()
+	handler := ResumableUpload(tusTestUpload{}, "file", store, "id")
+
+	m.Options("/uploads", handler)
+	m.Post("/uploads", handler)
+	m.Options("/uploads/:id", handler)
+	m.Head("/uploads/:id", handler)
+
+	var gotContent string
+	var gotErr error
+	m.Patch("/uploads/:id", handler, func(actual tusTestUpload, errs Errors) {
+		// Read the assembled upload here, inside the handler chain:
+		// completeTusUpload only removes its spilled temp file once every
+		// handler after it - this one included - has run.
+		if actual.File == nil {
+			gotErr = errors.New("expected a bound *multipart.FileHeader")
+			return
+		}
+		f, err := actual.File.Open()
+		if err != nil {
+			gotErr = err
+			return
+		}
+		defer f.Close()
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			gotErr = err
+			return
+		}
+		gotContent = string(data)
+	})
+
+	// completeTusUpload spills the assembled upload through the package's
+	// MaxMemory default (~10MB) rather than a per-call option, so exercising
+	// that path means uploading more than that much data.
+	data := strings.Repeat("z", 11<<20)
+
+	createReq, _ := http.NewRequest(http.MethodPost, "/uploads", nil)
+	createReq.Header.Set("Upload-Length", strconv.Itoa(len(data)))
+	createRec := httptest.NewRecorder()
+	m.ServeHTTP(createRec, createReq)
+	location := createRec.Header().Get("Location")
+
+	patch, _ := http.NewRequest(http.MethodPatch, location, strings.NewReader(data))
+	patch.Header.Set("Content-Type", "application/offset+octet-stream")
+	patch.Header.Set("Upload-Offset", "0")
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, patch)
+
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 after the final chunk, got %d", rec.Code)
+	}
+	if gotErr != nil {
+		t.Fatalf("downstream handler could not read the completed upload: %v", gotErr)
+	}
+	if gotContent != data {
+		t.Errorf("expected the downstream handler to see the full assembled upload")
+	}
+}
+
+func TestParseUploadMetadataRoundTrips(t *testing.T) {
+	encoded := "filename " + base64.StdEncoding.EncodeToString([]byte("a b.txt")) + ",filetype " + base64.StdEncoding.EncodeToString([]byte("text/plain"))
+
+	metadata, err := parseUploadMetadata(encoded)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if metadata["filename"] != "a b.txt" {
+		t.Errorf("expected filename 'a b.txt', got %q", metadata["filename"])
+	}
+	if metadata["filetype"] != "text/plain" {
+		t.Errorf("expected filetype 'text/plain', got %q", metadata["filetype"])
+	}
+}